@@ -6,6 +6,8 @@ import (
 	"path"
 	"path/filepath"
 	"time"
+
+	"github.com/hashicorp/vault-k8s/agent-inject/agent/templating"
 )
 
 const (
@@ -14,12 +16,27 @@ const (
 	DefaultTemplateType = "map"
 	PidFile             = "/home/vault/.pid"
 	TokenFile           = "/home/vault/.vault-token"
+
+	// ListenerTypeTCP is a cache listener bound to 127.0.0.1.
+	ListenerTypeTCP = "tcp"
+
+	// ListenerTypeInProc is a cache listener on a unix domain socket inside
+	// the agent container, so it is never exposed on the pod network.
+	ListenerTypeInProc = "unix"
+
+	// inProcCacheSocket is the socket path used as the address of a
+	// ListenerTypeInProc listener.
+	inProcCacheSocket = "/home/vault/.agent-cache.sock"
+
+	// ProjectedServiceAccountTokenPath is the default KubernetesAuthConfig.TokenPath,
+	// mounted by the webhook when AnnotationAgentUseProjectedServiceAccountToken is set.
+	ProjectedServiceAccountTokenPath = "/var/run/secrets/vault/token"
 )
 
 // Config is the top level struct that composes a Vault Agent
 // configuration file.
 type Config struct {
-	AutoAuth               *AutoAuth       `json:"auto_auth"`
+	AutoAuth               *AutoAuth       `json:"auto_auth,omitempty"`
 	ExitAfterAuth          bool            `json:"exit_after_auth"`
 	PidFile                string          `json:"pid_file"`
 	Vault                  *VaultConfig    `json:"vault"`
@@ -61,6 +78,41 @@ type Method struct {
 	ExitOnErr  bool                   `json:"exit_on_err,omitempty"`
 }
 
+// KubernetesAuthConfig is a structured view of the kubernetes auth method's config
+type KubernetesAuthConfig struct {
+	TokenPath            string `json:"token_path,omitempty"`
+	Audience             string `json:"audience,omitempty"`
+	ExpirationSeconds    int64  `json:"expiration_seconds,omitempty"`
+	TokenRefreshInterval string `json:"token_refresh_interval,omitempty"`
+}
+
+// merge overlays the non-zero fields of k onto a copy of config. config may
+// be nil.
+func (k *KubernetesAuthConfig) merge(config map[string]interface{}) map[string]interface{} {
+	merged := map[string]interface{}{}
+	for key, value := range config {
+		merged[key] = value
+	}
+
+	if k.TokenPath != "" {
+		merged["token_path"] = k.TokenPath
+	} else if _, ok := merged["token_path"]; !ok {
+		merged["token_path"] = ProjectedServiceAccountTokenPath
+	}
+
+	if k.Audience != "" {
+		merged["audience"] = k.Audience
+	}
+	if k.ExpirationSeconds != 0 {
+		merged["expiration_seconds"] = k.ExpirationSeconds
+	}
+	if k.TokenRefreshInterval != "" {
+		merged["token_refresh_interval"] = k.TokenRefreshInterval
+	}
+
+	return merged
+}
+
 // Sink defines a location to write the authenticated token
 type Sink struct {
 	Type       string                 `json:"type"`
@@ -73,16 +125,51 @@ type Sink struct {
 	Config     map[string]interface{} `json:"config,omitempty"`
 }
 
+// TokenSinkSpec describes one additional annotation-declared auto_auth
+// sink, supporting response-wrapped or curve25519-encrypted delivery.
+type TokenSinkSpec struct {
+	Name      string
+	Path      string
+	WrapTTL   string
+	DHType    string
+	DHPath    string
+	AAD       string
+	AADEnvVar string
+	Perms     string
+}
+
+// sink translates a TokenSinkSpec into the Sink stanza consumed by Config.
+func (s *TokenSinkSpec) sink() *Sink {
+	cfg := map[string]interface{}{
+		"path": s.Path,
+	}
+	if s.Perms != "" {
+		cfg["perms"] = s.Perms
+	}
+
+	return &Sink{
+		Type:       "file",
+		WrapTTLRaw: s.WrapTTL,
+		DHType:     s.DHType,
+		DHPath:     s.DHPath,
+		AAD:        s.AAD,
+		AADEnvVar:  s.AADEnvVar,
+		Config:     cfg,
+	}
+}
+
 // Template defines the Consul Template parameters
 type Template struct {
-	CreateDestDirs bool   `json:"create_dest_dirs,omitempty"`
-	Destination    string `json:"destination"`
-	Contents       string `json:"contents,omitempty"`
-	LeftDelim      string `json:"left_delimiter,omitempty"`
-	RightDelim     string `json:"right_delimiter,omitempty"`
-	Command        string `json:"command,omitempty"`
-	Source         string `json:"source,omitempty"`
-	Perms          string `json:"perms,omitempty"`
+	CreateDestDirs    bool   `json:"create_dest_dirs,omitempty"`
+	Destination       string `json:"destination"`
+	Contents          string `json:"contents,omitempty"`
+	LeftDelim         string `json:"left_delimiter,omitempty"`
+	RightDelim        string `json:"right_delimiter,omitempty"`
+	Command           string `json:"command,omitempty"`
+	Source            string `json:"source,omitempty"`
+	Perms             string `json:"perms,omitempty"`
+	ErrorOnMissingKey bool   `json:"error_on_missing_key,omitempty"`
+	ErrorFatal        bool   `json:"error_fatal,omitempty"`
 }
 
 // Listener defines the configuration for Vault Agent Cache Listener
@@ -102,6 +189,7 @@ type AgentAPI struct {
 type Cache struct {
 	UseAutoAuthToken string        `json:"use_auto_auth_token,omitempty"`
 	Persist          *CachePersist `json:"persist,omitempty"`
+	InProcDialer     bool          `json:"in_proc_dialer,omitempty"`
 }
 
 // CachePersist defines the configuration for persistent caching in Vault Agent
@@ -115,11 +203,25 @@ type CachePersist struct {
 
 // TemplateConfig defines the configuration for template_config in Vault Agent
 type TemplateConfig struct {
-	ExitOnRetryFailure         bool   `json:"exit_on_retry_failure"`
-	StaticSecretRenderInterval string `json:"static_secret_render_interval,omitempty"`
+	ExitOnRetryFailure         bool    `json:"exit_on_retry_failure"`
+	StaticSecretRenderInterval string  `json:"static_secret_render_interval,omitempty"`
+	MaxConnectionsPerHost      int     `json:"max_connections_per_host,omitempty"`
+	LeaseRenewalThreshold      float64 `json:"lease_renewal_threshold,omitempty"`
+	Retry                      *Retry  `json:"retry,omitempty"`
+}
+
+// Retry defines the template_config.retry stanza in Vault Agent. Attempts of
+// 0 means unlimited retries, which combined with ExitOnRetryFailure=false
+// keeps templates rendering across transient Vault outages instead of
+// killing the pod.
+type Retry struct {
+	Enabled    bool   `json:"enabled"`
+	Attempts   int    `json:"attempts"`
+	Backoff    string `json:"backoff,omitempty"`
+	MaxBackoff string `json:"max_backoff,omitempty"`
 }
 
-func (a *Agent) newTemplateConfigs() []*Template {
+func (a *Agent) newTemplateConfigs() ([]*Template, error) {
 	var templates []*Template
 	for _, secret := range a.Secrets {
 		template := secret.Template
@@ -133,6 +235,17 @@ func (a *Agent) newTemplateConfigs() []*Template {
 				case "map":
 					template = fmt.Sprintf(DefaultMapTemplate, secret.Path)
 				}
+			} else if templateType := secret.TemplateType; templateType == templating.EngineGo {
+				engine, ok := templating.Get(templating.EngineGo)
+				if !ok {
+					return nil, fmt.Errorf("no template engine registered for type %q", templateType)
+				}
+
+				rendered, err := engine.Render(secret.Path, template)
+				if err != nil {
+					return nil, fmt.Errorf("failed to render go template for secret %q: %w", secret.Name, err)
+				}
+				template = rendered
 			}
 		}
 
@@ -142,22 +255,90 @@ func (a *Agent) newTemplateConfigs() []*Template {
 		}
 
 		tmpl := &Template{
-			Source:      templateFile,
-			Contents:    template,
-			Destination: filePathAndName,
-			LeftDelim:   "{{",
-			RightDelim:  "}}",
-			Command:     secret.Command,
+			Source:            templateFile,
+			Contents:          template,
+			Destination:       filePathAndName,
+			LeftDelim:         "{{",
+			RightDelim:        "}}",
+			Command:           secret.Command,
+			ErrorOnMissingKey: secret.ErrorOnMissingKey,
+			ErrorFatal:        secret.ErrorFatal,
 		}
 		if secret.FilePermission != "" {
 			tmpl.Perms = secret.FilePermission
 		}
 		templates = append(templates, tmpl)
 	}
-	return templates
+	return templates, nil
+}
+
+// newAutoAuth builds the auto_auth stanza, or returns nil when the Agent is
+// only acting as a caching/proxy layer in front of a token supplied by
+// something else (e.g. the CSI driver), in which case auto_auth is omitted
+// from the rendered config entirely.
+func (a *Agent) newAutoAuth() *AutoAuth {
+	if a.DisableAutoAuth {
+		return nil
+	}
+
+	methodConfig := a.Vault.AuthConfig
+	if a.Vault.AuthType == "kubernetes" && a.UseProjectedServiceAccountToken {
+		kubernetesAuthConfig := a.Vault.KubernetesAuthConfig
+		if kubernetesAuthConfig == nil {
+			kubernetesAuthConfig = &KubernetesAuthConfig{}
+		}
+		methodConfig = kubernetesAuthConfig.merge(methodConfig)
+	}
+
+	autoAuth := &AutoAuth{
+		Method: &Method{
+			Type:       a.Vault.AuthType,
+			Namespace:  a.Vault.Namespace,
+			MountPath:  a.Vault.AuthPath,
+			Config:     methodConfig,
+			MinBackoff: a.Vault.AuthMinBackoff,
+			MaxBackoff: a.Vault.AuthMaxBackoff,
+			ExitOnErr:  a.AutoAuthExitOnError,
+		},
+		Sinks: []*Sink{
+			{
+				Type: "file",
+				Config: map[string]interface{}{
+					"path": TokenFile,
+				},
+			},
+		},
+	}
+
+	for _, tokenSink := range a.TokenSinks {
+		autoAuth.Sinks = append(autoAuth.Sinks, tokenSink.sink())
+	}
+
+	return autoAuth
+}
+
+// newTemplateRetry builds the template_config.retry stanza from the
+// Agent's VaultAgentTemplateConfig, or nil if retry behavior hasn't been
+// customized and Agent's own defaults should apply.
+func newTemplateRetry(cfg VaultAgentTemplateConfig) *Retry {
+	if !cfg.RetryEnabled && cfg.RetryAttempts == 0 && cfg.RetryBackoff == "" && cfg.RetryMaxBackoff == "" {
+		return nil
+	}
+
+	return &Retry{
+		Enabled:    cfg.RetryEnabled,
+		Attempts:   cfg.RetryAttempts,
+		Backoff:    cfg.RetryBackoff,
+		MaxBackoff: cfg.RetryMaxBackoff,
+	}
 }
 
 func (a *Agent) newConfig(init bool) ([]byte, error) {
+	templates, err := a.newTemplateConfigs()
+	if err != nil {
+		return nil, err
+	}
+
 	config := Config{
 		PidFile:       PidFile,
 		ExitAfterAuth: init,
@@ -170,35 +351,20 @@ func (a *Agent) newConfig(init bool) ([]byte, error) {
 			TLSSkipVerify: a.Vault.TLSSkipVerify,
 			TLSServerName: a.Vault.TLSServerName,
 		},
-		AutoAuth: &AutoAuth{
-			Method: &Method{
-				Type:       a.Vault.AuthType,
-				Namespace:  a.Vault.Namespace,
-				MountPath:  a.Vault.AuthPath,
-				Config:     a.Vault.AuthConfig,
-				MinBackoff: a.Vault.AuthMinBackoff,
-				MaxBackoff: a.Vault.AuthMaxBackoff,
-				ExitOnErr:  a.AutoAuthExitOnError,
-			},
-			Sinks: []*Sink{
-				{
-					Type: "file",
-					Config: map[string]interface{}{
-						"path": TokenFile,
-					},
-				},
-			},
-		},
-		Templates: a.newTemplateConfigs(),
+		AutoAuth:  a.newAutoAuth(),
+		Templates: templates,
 		TemplateConfig: &TemplateConfig{
 			ExitOnRetryFailure:         a.VaultAgentTemplateConfig.ExitOnRetryFailure,
 			StaticSecretRenderInterval: a.VaultAgentTemplateConfig.StaticSecretRenderInterval,
+			MaxConnectionsPerHost:      a.VaultAgentTemplateConfig.MaxConnectionsPerHost,
+			LeaseRenewalThreshold:      a.VaultAgentTemplateConfig.LeaseRenewalThreshold,
+			Retry:                      newTemplateRetry(a.VaultAgentTemplateConfig),
 		},
 		DisableIdleConnections: a.DisableIdleConnections,
 		DisableKeepAlives:      a.DisableKeepAlives,
 	}
 
-	if a.InjectToken {
+	if a.InjectToken && config.AutoAuth != nil {
 		config.AutoAuth.Sinks = append(config.AutoAuth.Sinks, &Sink{
 			Type: "file",
 			Config: map[string]interface{}{
@@ -207,7 +373,7 @@ func (a *Agent) newConfig(init bool) ([]byte, error) {
 		})
 	}
 
-	cacheListener := makeCacheListener(a.VaultAgentCache.ListenerPort)
+	cacheListener := makeCacheListener(a.VaultAgentCache.ListenerType, a.VaultAgentCache.ListenerPort)
 	if a.VaultAgentCache.Persist {
 		config.Listener = cacheListener
 		config.Cache = &Cache{
@@ -226,15 +392,17 @@ func (a *Agent) newConfig(init bool) ([]byte, error) {
 	}
 
 	// If EnableQuit is true, set it on the listener. If a listener hasn't been
-	// defined, set it on a new one. Also add a simple cache stanza since that's
-	// required for an agent listener.
+	// defined, or the only one is the in-process cache listener, set it on a
+	// new TCP one, since the quit endpoint must be reachable over the
+	// network. Also add a simple cache stanza since that's required for an
+	// agent listener.
 	if a.EnableQuit {
-		if len(config.Listener) > 0 {
+		if len(config.Listener) > 0 && config.Listener[0].Type != ListenerTypeInProc {
 			config.Listener[0].AgentAPI = &AgentAPI{
 				EnableQuit: a.EnableQuit,
 			}
 		} else {
-			config.Listener = makeCacheListener(a.VaultAgentCache.ListenerPort)
+			config.Listener = makeCacheListener(ListenerTypeTCP, a.VaultAgentCache.ListenerPort)
 			config.Listener[0].AgentAPI = &AgentAPI{
 				EnableQuit: a.EnableQuit,
 			}
@@ -245,6 +413,12 @@ func (a *Agent) newConfig(init bool) ([]byte, error) {
 		}
 	}
 
+	// InProcDialer must reflect the listener Agent actually ends up with,
+	// which EnableQuit may have forced back to TCP above.
+	if config.Cache != nil && len(config.Listener) > 0 {
+		config.Cache.InProcDialer = config.Listener[0].Type == ListenerTypeInProc
+	}
+
 	return config.render()
 }
 
@@ -252,10 +426,19 @@ func (c *Config) render() ([]byte, error) {
 	return json.Marshal(c)
 }
 
-func makeCacheListener(port string) []*Listener {
+func makeCacheListener(listenerType, port string) []*Listener {
+	if listenerType == ListenerTypeInProc {
+		return []*Listener{
+			{
+				Type:       ListenerTypeInProc,
+				Address:    inProcCacheSocket,
+				TLSDisable: true,
+			},
+		}
+	}
 	return []*Listener{
 		{
-			Type:       "tcp",
+			Type:       ListenerTypeTCP,
 			Address:    fmt.Sprintf("127.0.0.1:%s", port),
 			TLSDisable: true,
 		},
@@ -0,0 +1,186 @@
+package agent
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func testAgent() *Agent {
+	return &Agent{
+		Vault: &Vault{
+			Address:  "https://vault:8200",
+			AuthType: "kubernetes",
+			AuthPath: "auth/kubernetes",
+		},
+	}
+}
+
+func TestNewAutoAuth_Default(t *testing.T) {
+	a := testAgent()
+
+	autoAuth := a.newAutoAuth()
+	if autoAuth == nil {
+		t.Fatal("expected non-nil auto_auth")
+	}
+	if autoAuth.Method.Type != "kubernetes" {
+		t.Fatalf("unexpected method type: %s", autoAuth.Method.Type)
+	}
+	if len(autoAuth.Sinks) != 1 || autoAuth.Sinks[0].Config["path"] != TokenFile {
+		t.Fatalf("expected a single sink at %s, got %+v", TokenFile, autoAuth.Sinks)
+	}
+}
+
+func TestNewAutoAuth_Disabled(t *testing.T) {
+	a := testAgent()
+	a.DisableAutoAuth = true
+
+	if got := a.newAutoAuth(); got != nil {
+		t.Fatalf("expected nil auto_auth, got %+v", got)
+	}
+}
+
+func TestNewAutoAuth_TokenSinks(t *testing.T) {
+	a := testAgent()
+	a.TokenSinks = []*TokenSinkSpec{
+		{Path: "/vault/secrets/wrapped-token", WrapTTL: "30s", Perms: "0640"},
+	}
+
+	autoAuth := a.newAutoAuth()
+	if len(autoAuth.Sinks) != 2 {
+		t.Fatalf("expected default sink plus 1 token sink, got %d", len(autoAuth.Sinks))
+	}
+
+	extra := autoAuth.Sinks[1]
+	if extra.Config["path"] != "/vault/secrets/wrapped-token" {
+		t.Fatalf("unexpected sink path: %v", extra.Config["path"])
+	}
+	if extra.Config["perms"] != "0640" {
+		t.Fatalf("unexpected sink perms: %v", extra.Config["perms"])
+	}
+	if extra.WrapTTLRaw != "30s" {
+		t.Fatalf("unexpected wrap ttl: %v", extra.WrapTTLRaw)
+	}
+}
+
+func TestNewAutoAuth_ProjectedServiceAccountToken(t *testing.T) {
+	cases := []struct {
+		name              string
+		useProjectedToken bool
+		authConfig        map[string]interface{}
+		kubernetesAuth    *KubernetesAuthConfig
+		wantTokenPath     string
+	}{
+		{
+			name:              "opt-out leaves config untouched",
+			useProjectedToken: false,
+			authConfig:        map[string]interface{}{"role": "my-role"},
+			wantTokenPath:     "",
+		},
+		{
+			name:              "opt-in with no existing config gets the default path",
+			useProjectedToken: true,
+			wantTokenPath:     ProjectedServiceAccountTokenPath,
+		},
+		{
+			name:              "opt-in preserves an explicit token_path already present",
+			useProjectedToken: true,
+			authConfig:        map[string]interface{}{"token_path": "/custom/token"},
+			wantTokenPath:     "/custom/token",
+		},
+		{
+			name:              "opt-in with explicit KubernetesAuthConfig.TokenPath wins",
+			useProjectedToken: true,
+			authConfig:        map[string]interface{}{"token_path": "/custom/token"},
+			kubernetesAuth:    &KubernetesAuthConfig{TokenPath: "/configured/token"},
+			wantTokenPath:     "/configured/token",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			a := testAgent()
+			a.UseProjectedServiceAccountToken = tc.useProjectedToken
+			a.Vault.AuthConfig = tc.authConfig
+			a.Vault.KubernetesAuthConfig = tc.kubernetesAuth
+
+			autoAuth := a.newAutoAuth()
+			got, _ := autoAuth.Method.Config["token_path"].(string)
+			if got != tc.wantTokenPath {
+				t.Fatalf("expected token_path %q, got %q", tc.wantTokenPath, got)
+			}
+		})
+	}
+}
+
+func TestNewTemplateRetry(t *testing.T) {
+	cases := []struct {
+		name string
+		cfg  VaultAgentTemplateConfig
+		want *Retry
+	}{
+		{
+			name: "zero value is not configured",
+			cfg:  VaultAgentTemplateConfig{},
+			want: nil,
+		},
+		{
+			name: "enabled with unlimited attempts",
+			cfg:  VaultAgentTemplateConfig{RetryEnabled: true},
+			want: &Retry{Enabled: true},
+		},
+		{
+			name: "backoff set without explicitly enabling",
+			cfg:  VaultAgentTemplateConfig{RetryBackoff: "1s", RetryMaxBackoff: "10s"},
+			want: &Retry{Backoff: "1s", MaxBackoff: "10s"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := newTemplateRetry(tc.cfg)
+			if tc.want == nil {
+				if got != nil {
+					t.Fatalf("expected nil retry, got %+v", got)
+				}
+				return
+			}
+			if got == nil || *got != *tc.want {
+				t.Fatalf("expected %+v, got %+v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestNewConfig_InProcListenerWithEnableQuit(t *testing.T) {
+	a := testAgent()
+	a.VaultAgentCache = VaultAgentCache{
+		Enable:       true,
+		ListenerType: ListenerTypeInProc,
+		ListenerPort: "8200",
+	}
+	a.EnableQuit = true
+
+	raw, err := a.newConfig(false)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	var rendered struct {
+		Listener []struct {
+			Type string `json:"type"`
+		} `json:"listener"`
+		Cache struct {
+			InProcDialer bool `json:"in_proc_dialer"`
+		} `json:"cache"`
+	}
+	if err := json.Unmarshal(raw, &rendered); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if len(rendered.Listener) != 1 || rendered.Listener[0].Type != ListenerTypeTCP {
+		t.Fatalf("expected a single tcp listener, got %+v", rendered.Listener)
+	}
+	if rendered.Cache.InProcDialer {
+		t.Fatal("expected in_proc_dialer to be false once EnableQuit forces a TCP listener")
+	}
+}
@@ -0,0 +1,119 @@
+// Package templating lets the injector pre-render a user-authored template
+// into the consul-template syntax that Vault Agent expects in a Template's
+// Contents field. It exists so that request bodies can use a richer, more
+// Helm-like templating language (with helpers such as b64enc and toYaml)
+// while Agent still performs the actual Vault reads via consul-template.
+package templating
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"gopkg.in/yaml.v2"
+)
+
+// EngineGo is the registry key for the default Go text/template engine.
+const EngineGo = "go"
+
+// Engine renders a user-authored template for a given secret path into the
+// consul-template text that belongs in Template.Contents.
+type Engine interface {
+	Render(secretPath, rawTemplate string) (string, error)
+}
+
+// registry holds the set of known template engines, keyed by the
+// template_type annotation value that selects them.
+var registry = map[string]Engine{}
+
+// Register adds an Engine under name, overwriting any existing engine with
+// the same name. It is typically called from an engine's init function.
+func Register(name string, engine Engine) {
+	registry[name] = engine
+}
+
+// Get looks up a registered Engine by name.
+func Get(name string) (Engine, bool) {
+	engine, ok := registry[name]
+	return engine, ok
+}
+
+func init() {
+	Register(EngineGo, &GoEngine{})
+}
+
+// GoEngine renders templates with Go's text/template, augmented with a
+// small set of Helm-like helpers plus a `secret` function that emits the
+// consul-template block for looking up a Vault path. This lets a single
+// rendered file read from multiple Vault paths and reuse helpers instead of
+// hand-writing consul-template syntax.
+type GoEngine struct{}
+
+// Render parses and executes rawTemplate, returning the consul-template text
+// to store in Template.Contents. secretPath is exposed to the template as
+// the default path for the `secret` helper when called with no arguments.
+func (e *GoEngine) Render(secretPath, rawTemplate string) (string, error) {
+	tmpl, err := template.New("agent-go-template").Funcs(helperFuncs(secretPath)).Parse(rawTemplate)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse go template: %w", err)
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, nil); err != nil {
+		return "", fmt.Errorf("failed to render go template: %w", err)
+	}
+
+	return buf.String(), nil
+}
+
+// helperFuncs returns the FuncMap made available inside a rendered
+// template. defaultPath is used by the no-argument form of `secret`.
+func helperFuncs(defaultPath string) template.FuncMap {
+	return template.FuncMap{
+		"secret": func(path ...string) string {
+			p := defaultPath
+			if len(path) > 0 && path[0] != "" {
+				p = path[0]
+			}
+			return fmt.Sprintf("{{ with secret %q }}{{ range $k, $v := .Data }}{{ $k }}: {{ $v }}\n{{ end }}{{ end }}", p)
+		},
+		"b64enc":  b64enc,
+		"toYaml":  toYaml,
+		"nindent": nindent,
+		"quote":   quote,
+	}
+}
+
+// b64enc base64-encodes s, mirroring sprig's helper of the same name.
+func b64enc(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+// toYaml marshals v to a YAML document, trimming the trailing newline so
+// callers can control spacing with nindent.
+func toYaml(v interface{}) (string, error) {
+	out, err := yaml.Marshal(v)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal to yaml: %w", err)
+	}
+	return strings.TrimSuffix(string(out), "\n"), nil
+}
+
+// nindent indents every line of s by n spaces and prefixes it with a
+// newline, matching sprig's nindent.
+func nindent(n int, s string) string {
+	pad := strings.Repeat(" ", n)
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		lines[i] = pad + line
+	}
+	return "\n" + strings.Join(lines, "\n")
+}
+
+// quote returns s as a double-quoted, escaped string literal.
+func quote(s string) string {
+	return strconv.Quote(s)
+}
@@ -0,0 +1,74 @@
+package templating
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGoEngine_Render_Secret(t *testing.T) {
+	engine, ok := Get(EngineGo)
+	if !ok {
+		t.Fatal("expected go engine to be registered")
+	}
+
+	rendered, err := engine.Render("secret/data/foo", `{{ secret }}`)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if !strings.Contains(rendered, `with secret "secret/data/foo"`) {
+		t.Fatalf("expected rendered template to reference default path, got: %s", rendered)
+	}
+}
+
+func TestGoEngine_Render_SecretWithPath(t *testing.T) {
+	engine, ok := Get(EngineGo)
+	if !ok {
+		t.Fatal("expected go engine to be registered")
+	}
+
+	rendered, err := engine.Render("secret/data/foo", `{{ secret "secret/data/bar" }}`)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if !strings.Contains(rendered, `with secret "secret/data/bar"`) {
+		t.Fatalf("expected rendered template to reference overridden path, got: %s", rendered)
+	}
+}
+
+func TestGoEngine_Render_ParseError(t *testing.T) {
+	engine, _ := Get(EngineGo)
+	if _, err := engine.Render("secret/data/foo", `{{ .Broken`); err == nil {
+		t.Fatal("expected parse error")
+	}
+}
+
+func TestB64enc(t *testing.T) {
+	if got := b64enc("hello"); got != "aGVsbG8=" {
+		t.Fatalf("unexpected encoding: %s", got)
+	}
+}
+
+func TestToYaml(t *testing.T) {
+	got, err := toYaml(map[string]string{"key": "value"})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if got != "key: value" {
+		t.Fatalf("unexpected yaml: %q", got)
+	}
+}
+
+func TestNindent(t *testing.T) {
+	got := nindent(2, "a\nb")
+	if got != "\n  a\n  b" {
+		t.Fatalf("unexpected indent: %q", got)
+	}
+}
+
+func TestQuote(t *testing.T) {
+	if got := quote(`a"b`); got != `"a\"b"` {
+		t.Fatalf("unexpected quote: %q", got)
+	}
+}